@@ -5,21 +5,36 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/grafana/grafana/pkg/components/null"
+	"github.com/grafana/grafana/pkg/components/simplejson"
 	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/models"
 	"github.com/grafana/grafana/pkg/tsdb"
 	"github.com/pkg/errors"
 )
 
+// Defaults used when the datasource's jsonData doesn't configure them.
+const (
+	defaultDialTimeoutSeconds     = 10
+	defaultResponseTimeoutSeconds = 30
+	defaultMaxIdleConnsPerHost    = 100
+)
+
 type Clickhouse struct {
 	*models.DataSource
 	log         log.Logger
 	QueryParser *QueryParser
+	httpClient  *http.Client
+	// defaultQueryTimeout is used for queries whose model doesn't set an
+	// explicit queryTimeout.
+	defaultQueryTimeout time.Duration
 }
 
 type clickhouseResponse struct {
@@ -27,15 +42,66 @@ type clickhouseResponse struct {
 		Name string `json:"name"`
 		Type string `json:"type"`
 	} `json:"meta"`
-	Data []map[string]interface{} 	`json:"data"`
-	Rows int64               		`json:"rows"`
+	Data       []map[string]interface{} `json:"data"`
+	Rows       int64                    `json:"rows"`
+	Statistics clickhouseStatistics     `json:"statistics"`
+}
+
+// clickhouseStatistics mirrors the `statistics` block ClickHouse attaches to
+// FORMAT JSON responses.
+type clickhouseStatistics struct {
+	Elapsed   float64 `json:"elapsed"`
+	RowsRead  int64   `json:"rows_read"`
+	BytesRead int64   `json:"bytes_read"`
+}
+
+// clickhouseSummary mirrors the JSON object ClickHouse sends in the
+// X-ClickHouse-Summary response header. Counters are quoted strings there to
+// avoid precision loss on 64-bit values.
+type clickhouseSummary struct {
+	ReadRows  string `json:"read_rows"`
+	ReadBytes string `json:"read_bytes"`
+	ElapsedNs string `json:"elapsed_ns"`
 }
 
+// NewClickhouseExecutor builds the per-datasource HTTP client once, reading
+// dial/response timeouts and connection pooling from the datasource's
+// jsonData (dialTimeout, timeout, maxIdleConnsPerHost, all in seconds except
+// the last) so they're configurable per-datasource rather than fixed
+// constants.
 func NewClickhouseExecutor(dsInfo *models.DataSource) (tsdb.TsdbQueryEndpoint, error) {
+	jsonData := dsInfo.JsonData
+	if jsonData == nil {
+		jsonData = simplejson.New()
+	}
+
+	dialTimeout := time.Duration(jsonData.Get("dialTimeout").MustInt(defaultDialTimeoutSeconds)) * time.Second
+	queryTimeoutSeconds := jsonData.Get("timeout").MustInt(defaultResponseTimeoutSeconds)
+	if queryTimeoutSeconds <= 0 {
+		// A datasource saved with an empty/zero timeout field must still
+		// bound requests - an unbounded context means a stuck ClickHouse
+		// connection hangs the query forever instead of failing.
+		queryTimeoutSeconds = defaultResponseTimeoutSeconds
+	}
+	defaultQueryTimeout := time.Duration(queryTimeoutSeconds) * time.Second
+	maxIdleConnsPerHost := jsonData.Get("maxIdleConnsPerHost").MustInt(defaultMaxIdleConnsPerHost)
+
 	return &Clickhouse{
-		DataSource:  dsInfo,
-		log:         log.New("tsdb.clickhouse"),
-		QueryParser: &QueryParser{},
+		DataSource:          dsInfo,
+		log:                 log.New("tsdb.clickhouse"),
+		QueryParser:         &QueryParser{},
+		defaultQueryTimeout: defaultQueryTimeout,
+		httpClient: &http.Client{
+			// No client-wide Timeout: the per-query deadline below (driven
+			// by the model's queryTimeout, or defaultQueryTimeout otherwise)
+			// controls how long a request is allowed to run.
+			Transport: &http.Transport{
+				DialContext: (&net.Dialer{
+					Timeout: dialTimeout,
+				}).DialContext,
+				MaxIdleConnsPerHost: maxIdleConnsPerHost,
+			},
+		},
 	}, nil
 }
 
@@ -48,13 +114,13 @@ func (e *Clickhouse) Query(ctx context.Context, dsInfo *models.DataSource, tsdbQ
 	result.Results = make(map[string]*tsdb.QueryResult)
 
 	for _, query := range tsdbQuery.Queries {
-		result.Results[query.RefId] = e.executeQuery(query, tsdbQuery.TimeRange)
+		result.Results[query.RefId] = e.executeQuery(ctx, query, tsdbQuery.TimeRange)
 	}
 
 	return result, nil
 }
 
-func (e *Clickhouse) executeQuery(query *tsdb.Query, timeRange *tsdb.TimeRange) *tsdb.QueryResult {
+func (e *Clickhouse) executeQuery(ctx context.Context, query *tsdb.Query, timeRange *tsdb.TimeRange) *tsdb.QueryResult {
 	queryResult := tsdb.NewQueryResult()
 
 	queryString, err := e.QueryParser.Parse(query.Model, timeRange)
@@ -66,16 +132,36 @@ func (e *Clickhouse) executeQuery(query *tsdb.Query, timeRange *tsdb.TimeRange)
 	params := url.Values{}
 	params.Add("query", fmt.Sprintf("%s FORMAT JSON", queryString))
 
+	queryTimeout := e.defaultQueryTimeout
+	if modelTimeout := query.Model.Get("queryTimeout").MustInt(0); modelTimeout > 0 {
+		queryTimeout = time.Duration(modelTimeout) * time.Second
+	}
+	if queryTimeout > 0 {
+		params.Add("max_execution_time", strconv.Itoa(int(queryTimeout.Seconds())))
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, queryTimeout)
+		defer cancel()
+	}
+
 	if e.DataSource.BasicAuth {
 		params.Add("user", e.DataSource.BasicAuthUser)
 		params.Add("password", e.DataSource.DecryptedBasicAuthPassword())
 	}
 
-	response, err := http.Get(fmt.Sprintf("%s?%s", e.DataSource.Url, params.Encode()))
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s?%s", e.DataSource.Url, params.Encode()), nil)
+	if err != nil {
+		queryResult.Error = errors.Wrap(err, "Cannot build request")
+		return queryResult
+	}
+	req = req.WithContext(ctx)
+
+	response, err := e.httpClient.Do(req)
 	if err != nil {
 		queryResult.Error = errors.Wrap(err, "Request is failed")
 		return queryResult
 	}
+	defer response.Body.Close()
 
 	responseBody, err := ioutil.ReadAll(response.Body)
 	if err != nil {
@@ -89,6 +175,9 @@ func (e *Clickhouse) executeQuery(query *tsdb.Query, timeRange *tsdb.TimeRange)
 		queryResult.Error = errors.Wrapf(err, "Cannot parse the response: %s", responseBody)
 		return queryResult
 	}
+
+	e.attachQueryStatistics(queryResult, response, clickhouseResponse, query.RefId)
+
 	format := query.Model.Get("format").MustString("time_series")
 
 	switch format {
@@ -99,6 +188,21 @@ func (e *Clickhouse) executeQuery(query *tsdb.Query, timeRange *tsdb.TimeRange)
 			return queryResult
 		}
 		queryResult.Series = series
+	case "table":
+		table, err := e.buildTable(clickhouseResponse)
+		if err != nil {
+			queryResult.Error = err
+			return queryResult
+		}
+		queryResult.Tables = []*tsdb.Table{table}
+	case "logs":
+		table, err := e.buildLogs(query, clickhouseResponse)
+		if err != nil {
+			queryResult.Error = err
+			return queryResult
+		}
+		queryResult.Tables = []*tsdb.Table{table}
+		queryResult.Meta.Set("preferredVisualizationType", "logs")
 	default:
 		queryResult.Error = errors.Errorf("%s format does not support", format)
 	}
@@ -164,3 +268,149 @@ func (e *Clickhouse) buildSeries(responseJson *clickhouseResponse, timeRange *ts
 
 	return series, nil
 }
+
+// buildTable converts a ClickHouse response into a tsdb.Table, preserving
+// the column order from the `meta` block and typing each cell according to
+// its ClickHouse column type.
+func (e *Clickhouse) buildTable(responseJson *clickhouseResponse) (*tsdb.Table, error) {
+	table := &tsdb.Table{
+		Columns: make([]tsdb.TableColumn, 0, len(responseJson.Meta)),
+		Rows:    make([]tsdb.RowValues, 0, len(responseJson.Data)),
+	}
+
+	for _, meta := range responseJson.Meta {
+		table.Columns = append(table.Columns, tsdb.TableColumn{Text: meta.Name})
+	}
+
+	for _, row := range responseJson.Data {
+		values := make(tsdb.RowValues, len(responseJson.Meta))
+		for i, meta := range responseJson.Meta {
+			values[i] = convertClickhouseValue(meta.Type, row[meta.Name])
+		}
+		table.Rows = append(table.Rows, values)
+	}
+
+	return table, nil
+}
+
+// buildLogs converts a ClickHouse response into a tsdb.Table shaped for
+// Explore's logs view: a leading time column followed by the message/level
+// columns named on the query model (defaulting to "message"/"level").
+func (e *Clickhouse) buildLogs(query *tsdb.Query, responseJson *clickhouseResponse) (*tsdb.Table, error) {
+	if len(responseJson.Meta) == 0 {
+		return nil, errors.New("Response has no columns")
+	}
+
+	// time column is always first
+	timeColumnName := responseJson.Meta[0].Name
+	timeColumnType := responseJson.Meta[0].Type
+
+	messageColumn := query.Model.Get("messageColumn").MustString("message")
+	levelColumn := query.Model.Get("levelColumn").MustString("level")
+
+	table := &tsdb.Table{
+		Columns: []tsdb.TableColumn{
+			{Text: "time"},
+			{Text: "message"},
+			{Text: "level"},
+		},
+		Rows: make([]tsdb.RowValues, 0, len(responseJson.Data)),
+	}
+
+	for _, row := range responseJson.Data {
+		table.Rows = append(table.Rows, tsdb.RowValues{
+			convertClickhouseValue(timeColumnType, row[timeColumnName]),
+			fmt.Sprint(row[messageColumn]),
+			fmt.Sprint(row[levelColumn]),
+		})
+	}
+
+	return table, nil
+}
+
+// convertClickhouseValue coerces a raw JSON cell into a number or a
+// millisecond epoch, based on the ClickHouse type reported for its column in
+// the `meta` block. Cells of any other type, and cells that fail to parse,
+// are returned as decoded from the JSON without conversion.
+func convertClickhouseValue(chType string, value interface{}) interface{} {
+	switch {
+	case isClickhouseNumericType(chType):
+		if f, err := strconv.ParseFloat(fmt.Sprint(value), 64); err == nil {
+			return f
+		}
+	case isClickhouseDateTimeType(chType):
+		if ms, ok := parseClickhouseTime(chType, fmt.Sprint(value)); ok {
+			return ms
+		}
+	}
+
+	return value
+}
+
+func isClickhouseNumericType(chType string) bool {
+	return strings.HasPrefix(chType, "UInt") || strings.HasPrefix(chType, "Int") || strings.HasPrefix(chType, "Float")
+}
+
+func isClickhouseDateTimeType(chType string) bool {
+	return strings.HasPrefix(chType, "DateTime") || chType == "Date"
+}
+
+// parseClickhouseTime parses ClickHouse's JSON-format Date/DateTime strings
+// and returns the millisecond epoch Grafana expects on time columns.
+func parseClickhouseTime(chType, value string) (float64, bool) {
+	layout := "2006-01-02 15:04:05"
+	if chType == "Date" {
+		layout = "2006-01-02"
+	}
+
+	t, err := time.Parse(layout, value)
+	if err != nil {
+		return 0, false
+	}
+
+	return float64(t.UnixNano() / int64(time.Millisecond)), true
+}
+
+// attachQueryStatistics records ClickHouse's per-query profiling data onto
+// queryResult.Meta under "clickhouseStats", preferring the authoritative
+// X-ClickHouse-Summary response header over FORMAT JSON's own `statistics`
+// block, and logs the numbers at debug level so admins can grep slow
+// queries.
+func (e *Clickhouse) attachQueryStatistics(queryResult *tsdb.QueryResult, response *http.Response, chResponse *clickhouseResponse, refID string) {
+	rowsRead := chResponse.Statistics.RowsRead
+	bytesRead := chResponse.Statistics.BytesRead
+	elapsed := chResponse.Statistics.Elapsed
+
+	if summaryHeader := response.Header.Get("X-ClickHouse-Summary"); summaryHeader != "" {
+		var summary clickhouseSummary
+		if err := json.Unmarshal([]byte(summaryHeader), &summary); err != nil {
+			e.log.Debug("Cannot parse X-ClickHouse-Summary header", "error", err)
+		} else {
+			if v, err := strconv.ParseInt(summary.ReadRows, 10, 64); err == nil {
+				rowsRead = v
+			}
+			if v, err := strconv.ParseInt(summary.ReadBytes, 10, 64); err == nil {
+				bytesRead = v
+			}
+			if v, err := strconv.ParseInt(summary.ElapsedNs, 10, 64); err == nil {
+				elapsed = float64(v) / float64(time.Second)
+			}
+		}
+	}
+
+	queryID := response.Header.Get("X-ClickHouse-Query-Id")
+
+	stats := simplejson.New()
+	stats.Set("rowsRead", rowsRead)
+	stats.Set("bytesRead", bytesRead)
+	stats.Set("elapsed", elapsed)
+	stats.Set("queryId", queryID)
+
+	if queryResult.Meta == nil {
+		queryResult.Meta = simplejson.New()
+	}
+	queryResult.Meta.Set("clickhouseStats", stats)
+
+	e.log.Debug("ClickHouse query statistics", "refId", refID, "queryId", queryID,
+		"rowsRead", rowsRead, "bytesRead", bytesRead, "elapsed", elapsed)
+}
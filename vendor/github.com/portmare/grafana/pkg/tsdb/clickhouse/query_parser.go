@@ -5,7 +5,6 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/grafana/grafana/pkg/components/simplejson"
 	"github.com/grafana/grafana/pkg/tsdb"
@@ -41,10 +40,22 @@ func (qp *QueryParser) Parse(model *simplejson.Json, timeRange *tsdb.TimeRange)
 	if err != nil {
 		return "", err
 	}
+	formattedQuery, err = qp.ParseFromTo(formattedQuery, model, timeRange)
+	if err != nil {
+		return "", err
+	}
+	formattedQuery, err = qp.ParseConditionalTest(formattedQuery, model)
+	if err != nil {
+		return "", err
+	}
+	formattedQuery, err = qp.ParseAdhoc(formattedQuery, model)
+	if err != nil {
+		return "", err
+	}
 
 	reg := regexp.MustCompile(`\$\w*`)
 	if reg.MatchString(formattedQuery) {
-		return "", fmt.Errorf("Supports in query only $table, $timeSeries, $timeFilter, $interval")
+		return "", fmt.Errorf("Supports in query only $table, $timeSeries, $timeFilter, $interval, $from, $to, $adhoc, $conditionalTest")
 	}
 
 	return formattedQuery, nil
@@ -113,17 +124,49 @@ func (qp *QueryParser) ParseTimeFilter(query string, model *simplejson.Json, tim
 		return query, err
 	}
 
-	from, to := qp.GetTimeRangeAsTimestamps(timeRange, dateTimeType == "DATETIME")
+	from, to, err := qp.GetTimeRangeAsTimestamps(timeRange)
+	if err != nil {
+		return query, err
+	}
+	isDateTime := dateTimeType == "DATETIME"
+
 	var result string
 	if timeRange.To == "now" {
-		result = fmt.Sprintf("%s >= %s", dateTimeColumnName, from)
+		result = fmt.Sprintf("%s >= %s", dateTimeColumnName, formatLegacyTimeBoundary(from, isDateTime))
 	} else {
-		result = fmt.Sprintf("%s BETWEEN %s AND %s", dateTimeColumnName, from, to)
+		result = fmt.Sprintf("%s BETWEEN %s AND %s", dateTimeColumnName, formatLegacyTimeBoundary(from, isDateTime), formatLegacyTimeBoundary(to, isDateTime))
 	}
 
 	return reg.ReplaceAllString(query, result), nil
 }
 
+// ParseFromTo replaces $from/$to with the resolved ClickHouse time literal
+// for the dashboard's time range, so dashboard authors can build custom
+// WHERE clauses without relying solely on $timeFilter.
+func (qp *QueryParser) ParseFromTo(query string, model *simplejson.Json, timeRange *tsdb.TimeRange) (string, error) {
+	fromReg := regexp.MustCompile(`\$from\b`)
+	toReg := regexp.MustCompile(`\$to\b`)
+	if !fromReg.MatchString(query) && !toReg.MatchString(query) {
+		return query, nil
+	}
+
+	_, dateTimeType, err := qp.GetDateTimeColumn(model)
+	if err != nil {
+		return query, err
+	}
+
+	from, to, err := qp.GetTimeRangeAsTimestamps(timeRange)
+	if err != nil {
+		return query, err
+	}
+	isDateTime := dateTimeType == "DATETIME"
+
+	query = fromReg.ReplaceAllString(query, formatTimeLiteral(from, isDateTime))
+	query = toReg.ReplaceAllString(query, formatTimeLiteral(to, isDateTime))
+
+	return query, nil
+}
+
 // GetInterval generate interval in seconds for time series by step and interval from data of model
 func (qp *QueryParser) GetInterval(model *simplejson.Json) int {
 	intervalFactor, err := model.Get("intervalFactor").Int()
@@ -136,23 +179,34 @@ func (qp *QueryParser) GetInterval(model *simplejson.Json) int {
 	return intervalFactor * qp.IntervalToSeconds(intervalStr)
 }
 
-// IntervalToSeconds convert interval's string to seconds, exp. IntervalToSeconds("5m") => 300
+var durationComponentPattern = regexp.MustCompile(`(\d+)([a-zA-Z]+)`)
+
+// IntervalToSeconds convert interval's string to seconds, exp. IntervalToSeconds("5m") => 300.
+// It also accepts compound durations like Prometheus/Bosun do, exp. IntervalToSeconds("1h30m15s") => 5415.
 func (qp *QueryParser) IntervalToSeconds(intervalStr string) int {
 	if intervalStr == "" {
 		return 1
 	}
 
-	re := regexp.MustCompile(`^(\d+)(\w+)$`)
-	matches := re.FindAllStringSubmatch(intervalStr, -1)
-	if len(matches[0]) == 3 {
-		value, _ := strconv.Atoi(matches[0][1])
-		step := intervalSteps[string(matches[0][2])]
-		if value > 0 && step > 0 {
-			return value * step
+	matches := durationComponentPattern.FindAllStringSubmatch(intervalStr, -1)
+	total := 0
+	for _, match := range matches {
+		value, err := strconv.Atoi(match[1])
+		if err != nil {
+			continue
+		}
+		step, ok := intervalSteps[match[2]]
+		if !ok {
+			continue
 		}
+		total += value * step
+	}
+
+	if total <= 0 {
+		return 1
 	}
 
-	return 1
+	return total
 }
 
 // GetDateTimeColumn return date or datetime column with date type
@@ -175,21 +229,237 @@ func (qp *QueryParser) GetDateTimeColumn(model *simplejson.Json) (string, string
 	return dateTimeColumnName, dateTimeType, nil
 }
 
-// GetTimeRangeAsTimestamps return interval from time range
-func (qp *QueryParser) GetTimeRangeAsTimestamps(timeRange *tsdb.TimeRange, isDateTime bool) (string, string) {
-	now := time.Now().Unix()
-	from := now - int64(qp.IntervalToSeconds(timeRange.From))
+// GetTimeRangeAsTimestamps resolves timeRange into Unix timestamps (seconds),
+// deferring to tsdb.TimeRange's own datemath (the same GetFromAsMsEpoch/
+// GetToAsMsEpoch used by buildSeries) rather than re-parsing timeRange.From/To
+// ourselves. That datemath already rounds quick ranges like "Today"/"This
+// week" down on the from side and up on the to side, and understands every
+// relative unit Grafana's picker can send (s/m/h/d/w/M/y), not just the ones
+// a hand-rolled parser happens to cover.
+func (qp *QueryParser) GetTimeRangeAsTimestamps(timeRange *tsdb.TimeRange) (int64, int64, error) {
+	return timeRange.GetFromAsMsEpoch() / 1000, timeRange.GetToAsMsEpoch() / 1000, nil
+}
 
-	matches := strings.Split(timeRange.To, "-")
-	var to int64
-	if to = now; len(matches) > 1 {
-		to -= int64(qp.IntervalToSeconds(timeRange.To))
+// formatLegacyTimeBoundary renders a resolved Unix timestamp the way
+// $timeFilter has always compared against a DATETIME column: a bare epoch
+// integer (ClickHouse compares DateTime columns against integers directly).
+// Kept as-is so existing dashboard SQL built around $timeFilter doesn't
+// change underneath them.
+func formatLegacyTimeBoundary(unixSeconds int64, isDateTime bool) string {
+	if isDateTime {
+		return strconv.FormatInt(unixSeconds, 10)
 	}
 
-	var pattern string
-	if pattern = "%d"; !isDateTime {
-		pattern = "toDate(%d)"
+	return formatDateBoundary(unixSeconds)
+}
+
+// formatTimeLiteral renders a resolved Unix timestamp as an explicit
+// ClickHouse toDateTime()/toDate() literal, for the new $from/$to macros.
+func formatTimeLiteral(unixSeconds int64, isDateTime bool) string {
+	if isDateTime {
+		return fmt.Sprintf("toDateTime(%d)", unixSeconds)
+	}
+
+	return formatDateBoundary(unixSeconds)
+}
+
+// formatDateBoundary renders a resolved Unix timestamp as a ClickHouse
+// toDate() literal, shared by both the legacy and new time-boundary
+// formatters so DATE-column handling only has one place to fix.
+func formatDateBoundary(unixSeconds int64) string {
+	return fmt.Sprintf("toDate(%d)", unixSeconds)
+}
+
+var safeIdentifierPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.]*$`)
+
+var comparisonAdhocOperators = map[string]bool{
+	"=":  true,
+	"!=": true,
+	"<>": true,
+	"<":  true,
+	"<=": true,
+	">":  true,
+	">=": true,
+}
+
+// ParseAdhoc replaces $adhoc with an AND-joined WHERE fragment built from
+// the ad-hoc filters Grafana's frontend ships on the query model
+// (key/operator/value triples), or "1=1" when there are none. The regex
+// operators =~/!~ map to ClickHouse's match()/NOT match(); any other
+// unrecognized operator is dropped rather than failing the query. Values are
+// escaped according to the column's type, taken from an explicit
+// adhocColumnTypes map on the model or, failing that, the dateTimeColDataType
+// hint, to keep dashboard variables from being able to inject SQL.
+func (qp *QueryParser) ParseAdhoc(query string, model *simplejson.Json) (string, error) {
+	reg := regexp.MustCompile(`\$adhoc`)
+	if !reg.MatchString(query) {
+		return query, nil
+	}
+
+	filters, _ := model.Get("adhocFilters").Array()
+	if len(filters) == 0 {
+		return reg.ReplaceAllString(query, "1=1"), nil
+	}
+
+	columnTypes := qp.adhocColumnTypes(model)
+
+	clauses := make([]string, 0, len(filters))
+	for _, raw := range filters {
+		filter, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		key := fmt.Sprint(filter["key"])
+		operator := fmt.Sprint(filter["operator"])
+		value := fmt.Sprint(filter["value"])
+
+		if !safeIdentifierPattern.MatchString(key) {
+			return query, fmt.Errorf("Adhoc filter has an unsupported column name %q", key)
+		}
+
+		var clause string
+		switch {
+		case comparisonAdhocOperators[operator]:
+			clause = fmt.Sprintf("%s %s %s", key, operator, qp.escapeAdhocValue(value, columnTypes[key]))
+		case operator == "=~":
+			clause = fmt.Sprintf("match(%s, %s)", key, qp.escapeAdhocString(value))
+		case operator == "!~":
+			clause = fmt.Sprintf("NOT match(%s, %s)", key, qp.escapeAdhocString(value))
+		default:
+			// Grafana's ad-hoc filter UI can send operators we don't know
+			// about; drop the filter rather than failing every panel on
+			// the dashboard.
+			continue
+		}
+
+		clauses = append(clauses, clause)
+	}
+
+	if len(clauses) == 0 {
+		return reg.ReplaceAllString(query, "1=1"), nil
+	}
+
+	return reg.ReplaceAllString(query, strings.Join(clauses, " AND ")), nil
+}
+
+// adhocColumnTypes resolves the type ("number", "datetime" or "string") to
+// use for each ad-hoc filter column: an explicit adhocColumnTypes map on the
+// model takes precedence, falling back to the dashboard's configured
+// date/datetime column.
+func (qp *QueryParser) adhocColumnTypes(model *simplejson.Json) map[string]string {
+	columnTypes := map[string]string{}
+
+	if dateTimeColumnName, _, err := qp.GetDateTimeColumn(model); err == nil && dateTimeColumnName != "" {
+		columnTypes[dateTimeColumnName] = "datetime"
+	}
+
+	configured, err := model.Get("adhocColumnTypes").Map()
+	if err != nil {
+		return columnTypes
+	}
+	for column, columnType := range configured {
+		columnTypes[column] = fmt.Sprint(columnType)
+	}
+
+	return columnTypes
+}
+
+// escapeAdhocValue renders value as a ClickHouse literal safe to splice into
+// a WHERE clause, based on the column's discovered type.
+func (qp *QueryParser) escapeAdhocValue(value, columnType string) string {
+	switch columnType {
+	case "number":
+		if _, err := strconv.ParseFloat(value, 64); err == nil {
+			return value
+		}
+		return "NULL"
+	case "datetime":
+		return fmt.Sprintf("toDateTime(%s)", qp.escapeAdhocString(value))
+	default:
+		return qp.escapeAdhocString(value)
+	}
+}
+
+// escapeAdhocString renders value as a quoted ClickHouse string literal,
+// used both for string-typed columns and as the pattern argument to
+// match()/NOT match() for the =~/!~ ad-hoc operators. Backslashes are doubled
+// and single quotes are doubled, so neither can end the literal early.
+func (qp *QueryParser) escapeAdhocString(value string) string {
+	escaped := strings.Replace(value, `\`, `\\`, -1)
+	return fmt.Sprintf("'%s'", strings.Replace(escaped, "'", "''", -1))
+}
+
+const conditionalTestPrefix = "$conditionalTest("
+
+// ParseConditionalTest replaces $conditionalTest(<expr>, $var) with <expr>
+// when the referenced template variable is set to a non-"All" value, and
+// with "1" otherwise, so multi-value "All" selections don't filter anything
+// out. <expr> is split from $var by scanning for the call's matching closing
+// paren and its last top-level comma, rather than a regex that would mis-split
+// on a comma inside <expr> itself (e.g. "col IN (1,2)").
+func (qp *QueryParser) ParseConditionalTest(query string, model *simplejson.Json) (string, error) {
+	if !strings.Contains(query, conditionalTestPrefix) {
+		return query, nil
+	}
+
+	var out strings.Builder
+	rest := query
+	for {
+		idx := strings.Index(rest, conditionalTestPrefix)
+		if idx == -1 {
+			out.WriteString(rest)
+			break
+		}
+		out.WriteString(rest[:idx])
+
+		argStart := idx + len(conditionalTestPrefix)
+		lastComma, closeParen, ok := findConditionalTestArgs(rest, argStart)
+		if !ok {
+			// Malformed/unterminated macro call; leave it untouched so the
+			// "unsupported macro" guard in Parse reports it.
+			out.WriteString(rest[idx:])
+			break
+		}
+
+		expr := strings.TrimSpace(rest[argStart:lastComma])
+		varName := strings.TrimPrefix(strings.TrimSpace(rest[lastComma+1:closeParen]), "$")
+
+		text := model.GetPath("scopedVars", varName, "text").MustString("All")
+		if strings.EqualFold(text, "All") {
+			out.WriteString("1")
+		} else {
+			out.WriteString(expr)
+		}
+
+		rest = rest[closeParen+1:]
+	}
+
+	return out.String(), nil
+}
+
+// findConditionalTestArgs scans a $conditionalTest( call starting just after
+// its opening paren, tracking paren depth so nested calls/expressions don't
+// confuse it, and returns the index of the last top-level comma and the
+// index of the call's matching closing paren.
+func findConditionalTestArgs(s string, argStart int) (lastTopLevelComma, closeParen int, ok bool) {
+	depth := 1
+	lastTopLevelComma = -1
+	for i := argStart; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return lastTopLevelComma, i, lastTopLevelComma != -1
+			}
+		case ',':
+			if depth == 1 {
+				lastTopLevelComma = i
+			}
+		}
 	}
 
-	return fmt.Sprintf(pattern, from), fmt.Sprintf(pattern, to)
+	return -1, -1, false
 }